@@ -0,0 +1,267 @@
+/*
+ * canonicalize.go
+ *
+ * A SQL-aware normalizer that turns a raw query into a canonical form
+ * suitable for use as a qbuf bucket key: literals collapsed to "?", but
+ * identifiers, keywords, and comments left alone, except that the hostname
+ * is dropped from a "/* host:route *\/" hint.
+ */
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// paramRunRE matches a parenthesized run of two or more "?" placeholders
+// separated by commas, e.g. "(?, ?, ?)", so that IN (...)/VALUES (...)
+// lists of any length hash to the same bucket.
+var paramRunRE = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+
+// Canonicalize rewrites query into a canonical form: string/numeric/hex/bit
+// literals become "?", runs of "?" inside parentheses collapse to a single
+// "?", each run of whitespace becomes a single space (or a single newline if
+// the run contains one), the hostname is removed from a leading
+// "/* host:route */" hint, and everything else (keywords, identifiers,
+// operators, comments) is preserved verbatim.
+func Canonicalize(query []byte) string {
+	if verbose && noclean {
+		return string(query)
+	}
+
+	var out []byte
+	n := len(query)
+	for i := 0; i < n; {
+		c := query[i]
+		switch {
+		case c == '\'':
+			j := scanQuoted(query, i, '\'', true)
+			out = append(out, '?')
+			i = j
+
+		case c == '"':
+			j := scanQuoted(query, i, '"', false)
+			out = append(out, query[i:j]...)
+			i = j
+
+		case c == '`':
+			j := scanQuoted(query, i, '`', false)
+			out = append(out, query[i:j]...)
+			i = j
+
+		case c == '-' && i+1 < n && query[i+1] == '-':
+			j := scanLineComment(query, i)
+			out = append(out, query[i:j]...)
+			i = j
+
+		case c == '#':
+			j := scanLineComment(query, i)
+			out = append(out, query[i:j]...)
+			i = j
+
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			j := scanBlockComment(query, i)
+			out = append(out, query[i:j]...)
+			i = j
+
+		case c == '0' && i+1 < n && (query[i+1] == 'x' || query[i+1] == 'X'):
+			j := scanHexLiteral(query, i)
+			out = append(out, '?')
+			i = j
+
+		case (c == 'b' || c == 'B') && i+1 < n && query[i+1] == '\'' && !precededByIdentChar(query, i):
+			j := scanQuoted(query, i+1, '\'', false)
+			out = append(out, '?')
+			i = j
+
+		case isDigit(c), c == '-' && i+1 < n && isDigit(query[i+1]) && !precededByValue(out):
+			j := scanNumber(query, i)
+			out = append(out, '?')
+			i = j
+
+		case isSpace(c):
+			j := i + 1
+			hasNewline := c == '\n'
+			for j < n && isSpace(query[j]) {
+				if query[j] == '\n' {
+					hasNewline = true
+				}
+				j++
+			}
+			// Collapsing a run that crosses a newline down to a plain space
+			// would erase the newline that terminates a preceding --/# line
+			// comment, silently commenting out everything after it on the
+			// canonicalized text. Preserve the newline instead.
+			if hasNewline {
+				out = append(out, '\n')
+			} else {
+				out = append(out, ' ')
+			}
+			i = j
+
+		case isIdentStart(c):
+			j := i + 1
+			for j < n && isIdentChar(query[j]) {
+				j++
+			}
+			out = append(out, query[i:j]...)
+			i = j
+
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+
+	return stripRouteHostname(collapseParamRuns(string(out)))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || (c >= 9 && c <= 13)
+}
+
+func isIdentStart(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '$'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+// precededByIdentChar reports whether the byte just before query[i] is part
+// of an identifier, so we don't mistake the tail of a word like "orb" for
+// the start of a bit-literal "b'...'".
+func precededByIdentChar(query []byte, i int) bool {
+	return i > 0 && isIdentChar(query[i-1])
+}
+
+// precededByValue reports whether the last byte written to out is the end
+// of a value (an identifier, a number, or a closing paren/quote), meaning a
+// following "-" is a binary subtraction operator rather than the sign of a
+// negative number literal. Numbers and single-quoted strings have already
+// been written to out as "?", so "?" counts as the end of a value too.
+func precededByValue(out []byte) bool {
+	if len(out) == 0 {
+		return false
+	}
+	c := out[len(out)-1]
+	return isIdentChar(c) || c == ')' || c == '`' || c == '"' || c == '?'
+}
+
+// scanQuoted returns the index just past a quote/backtick-delimited token
+// starting at query[start], honoring doubled-quote escapes and, when
+// allowBackslash is set, backslash escapes too.
+func scanQuoted(query []byte, start int, quote byte, allowBackslash bool) int {
+	n := len(query)
+	for i := start + 1; i < n; i++ {
+		switch query[i] {
+		case '\\':
+			if allowBackslash {
+				i++
+				continue
+			}
+		case quote:
+			if i+1 < n && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return n
+}
+
+// scanLineComment returns the index of the end of the line (or input).
+func scanLineComment(query []byte, start int) int {
+	n := len(query)
+	for i := start; i < n; i++ {
+		if query[i] == '\n' {
+			return i
+		}
+	}
+	return n
+}
+
+// scanBlockComment returns the index just past the closing "*/", or the end
+// of input if it's never closed.
+func scanBlockComment(query []byte, start int) int {
+	n := len(query)
+	for i := start + 2; i < n; i++ {
+		if query[i] == '*' && i+1 < n && query[i+1] == '/' {
+			return i + 2
+		}
+	}
+	return n
+}
+
+// scanHexLiteral returns the index just past a "0x"/"0X" hex literal.
+func scanHexLiteral(query []byte, start int) int {
+	n := len(query)
+	i := start + 2
+	for i < n && isHexDigit(query[i]) {
+		i++
+	}
+	return i
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// scanNumber returns the index just past an integer, float, or
+// scientific-notation numeric literal (with an optional leading "-")
+// starting at query[start].
+func scanNumber(query []byte, start int) int {
+	n := len(query)
+	i := start
+	if query[i] == '-' {
+		i++
+	}
+	for i < n && isDigit(query[i]) {
+		i++
+	}
+	if i < n && query[i] == '.' {
+		j := i + 1
+		for j < n && isDigit(query[j]) {
+			j++
+		}
+		if j > i+1 {
+			i = j
+		}
+	}
+	if i < n && (query[i] == 'e' || query[i] == 'E') {
+		j := i + 1
+		if j < n && (query[j] == '+' || query[j] == '-') {
+			j++
+		}
+		k := j
+		for k < n && isDigit(query[k]) {
+			k++
+		}
+		if k > j {
+			i = k
+		}
+	}
+	return i
+}
+
+// collapseParamRuns turns "(?, ?, ?)"-style runs into a single "(?)" so
+// that IN/VALUES lists of differing length hash to the same qbuf bucket.
+func collapseParamRuns(s string) string {
+	return paramRunRE.ReplaceAllString(s, "(?)")
+}
+
+// stripRouteHostname removes the hostname from a "/* host:route */" hint
+// so that routes from different hosts condense into the same bucket.
+func stripRouteHostname(s string) string {
+	parts := strings.SplitN(s, " ", 5)
+	if len(parts) >= 5 && parts[1] == "/*" && parts[3] == "*/" && strings.Contains(parts[2], ":") {
+		return parts[0] + " /* " + strings.SplitN(parts[2], ":", 2)[1] + " */ " + parts[4]
+	}
+	return s
+}
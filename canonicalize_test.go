@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+
+func TestCanonicalize(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "single-quoted string",
+			input: "SELECT * FROM users WHERE name = 'bob'",
+			want:  "SELECT * FROM users WHERE name = ?",
+		},
+		{
+			name:  "single-quoted string with doubled-quote escape",
+			input: "SELECT * FROM users WHERE name = 'o''brien'",
+			want:  "SELECT * FROM users WHERE name = ?",
+		},
+		{
+			name:  "single-quoted string with backslash escape",
+			input: `SELECT * FROM users WHERE name = 'o\'brien'`,
+			want:  "SELECT * FROM users WHERE name = ?",
+		},
+		{
+			name:  "double-quoted identifier preserved",
+			input: `SELECT "col" FROM t WHERE x = 'v'`,
+			want:  `SELECT "col" FROM t WHERE x = ?`,
+		},
+		{
+			name:  "backtick-quoted identifier preserved",
+			input: "SELECT `col` FROM `t` WHERE x = 'v'",
+			want:  "SELECT `col` FROM `t` WHERE x = ?",
+		},
+		{
+			name:  "line comment with --",
+			input: "SELECT 1 -- trailing comment\nFROM t",
+			want:  "SELECT ? -- trailing comment\nFROM t",
+		},
+		{
+			name:  "line comment with #",
+			input: "SELECT 1 # trailing comment\nFROM t",
+			want:  "SELECT ? # trailing comment\nFROM t",
+		},
+		{
+			name:  "block comment preserved",
+			input: "SELECT /* a block comment */ 1",
+			want:  "SELECT /* a block comment */ ?",
+		},
+		{
+			name:  "route hint hostname stripped",
+			input: "SELECT /* db01:users.lookup */ 1",
+			want:  "SELECT /* users.lookup */ ?",
+		},
+		{
+			name:  "hex literal",
+			input: "SELECT * FROM t WHERE x = 0xFF",
+			want:  "SELECT * FROM t WHERE x = ?",
+		},
+		{
+			name:  "bit literal",
+			input: "SELECT * FROM t WHERE flags = b'1010'",
+			want:  "SELECT * FROM t WHERE flags = ?",
+		},
+		{
+			name:  "identifier ending in b not mistaken for bit literal",
+			input: "SELECT * FROM t WHERE orb = 'x'",
+			want:  "SELECT * FROM t WHERE orb = ?",
+		},
+		{
+			name:  "integer literal",
+			input: "SELECT * FROM t WHERE id = 42",
+			want:  "SELECT * FROM t WHERE id = ?",
+		},
+		{
+			name:  "negative integer literal",
+			input: "SELECT * FROM t WHERE id = -42",
+			want:  "SELECT * FROM t WHERE id = ?",
+		},
+		{
+			name:  "subtraction not mistaken for negative literal",
+			input: "SELECT a - 1 FROM t",
+			want:  "SELECT a - ? FROM t",
+		},
+		{
+			name:  "float literal",
+			input: "SELECT * FROM t WHERE price = 3.14",
+			want:  "SELECT * FROM t WHERE price = ?",
+		},
+		{
+			name:  "scientific notation literal",
+			input: "SELECT * FROM t WHERE price = 1.5e-10",
+			want:  "SELECT * FROM t WHERE price = ?",
+		},
+		{
+			name:  "IN list collapses to single placeholder",
+			input: "SELECT * FROM t WHERE id IN (?, ?, ?)",
+			want:  "SELECT * FROM t WHERE id IN (?)",
+		},
+		{
+			name:  "VALUES list collapses to single placeholder",
+			input: "INSERT INTO t VALUES (?, ?, ?, ?)",
+			want:  "INSERT INTO t VALUES (?)",
+		},
+		{
+			name:  "mixed literals in one query",
+			input: "SELECT * FROM t WHERE a = 'x' AND b = 5 AND c IN (1, 2, 3)",
+			want:  "SELECT * FROM t WHERE a = ? AND b = ? AND c IN (?)",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := Canonicalize([]byte(c.input))
+			if got != c.want {
+				t.Errorf("Canonicalize(%q) = %q, want %q", c.input, got, c.want)
+			}
+		})
+	}
+}
@@ -4,12 +4,6 @@
  * A straightforward program for sniffing MySQL query streams and providing
  * diagnostic information on the realtime queries your database is handling.
  *
- * FIXME: this assumes IPv4.
- * FIXME: tokenizer doesn't handle negative numbers or floating points.
- * FIXME: canonicalizer should collapse "IN (?,?,?,?)" and "VALUES (?,?,?,?)"
- * FIXME: tokenizer breaks on '"' or similarly embedded quotes
- * FIXME: tokenizer parses numbers in words wrong, i.e. s2compiled -> s?compiled
- *
  * written by Mark Smith <mark@qq.is>
  *
  *
@@ -18,11 +12,13 @@
 package main
 
 import (
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/tcpassembly"
 	"log"
 	"math/rand"
 	"sort"
@@ -31,12 +27,6 @@ import (
 )
 
 const (
-	TOKEN_WORD       = 0
-	TOKEN_QUOTE      = 1
-	TOKEN_NUMBER     = 2
-	TOKEN_WHITESPACE = 3
-	TOKEN_OTHER      = 4
-
 	// Internal tuning
 	TIME_BUCKETS = 10000
 
@@ -49,7 +39,11 @@ const (
 	COLOR_DEFAULT = "\x1b[39m"
 
 	// MySQL packet types
-	COM_QUERY = 3
+	COM_QUERY        = 3
+	COM_STMT_PREPARE = 0x16
+	COM_STMT_EXECUTE = 0x17
+	COM_STMT_CLOSE   = 0x19
+	COM_STMT_RESET   = 0x1a
 
 	// These are used for formatting outputs
 	F_NONE = iota
@@ -59,6 +53,13 @@ const (
 	F_SOURCEIP
 )
 
+// Address families, tracked per session so status updates can report the
+// split between IPv4 and IPv6 traffic.
+const (
+	FAMILY_IPV4 = iota
+	FAMILY_IPV6
+)
+
 type packet struct {
 	request bool // request or response
 	data    []byte
@@ -70,29 +71,63 @@ type sortable struct {
 }
 type sortableSlice []sortable
 
-type source struct {
-	src       string
-	srcip     string
-	synced    bool
-	reqbuffer []byte
-	resbuffer []byte
-	reqSent   *time.Time
-	reqTimes  [TIME_BUCKETS]uint64
-	qbytes    uint64
-	qdata     *queryData
-	qtext     string
+// session tracks both directions of a single TCP connection between a
+// client and the MySQL server, so request and response bytes are
+// correlated even when they arrive in separate, out-of-order, or
+// retransmitted TCP segments.
+type session struct {
+	src        string
+	srcip      string
+	family     int // FAMILY_IPV4 or FAMILY_IPV6
+	synced     bool
+	halfClosed int // number of directions that have called ReassemblyComplete
+	lastActive time.Time
+	reqbuffer  []byte
+	resbuffer  []byte
+	reqSent    *time.Time
+	reqTimes   [TIME_BUCKETS]uint64
+	qbytes     uint64
+	qdata      *queryData
+	qtext      string
+
+	// resState tracks where we are in decoding a (possibly multi-packet)
+	// response: a bare OK/ERR, a result set's column defs/EOF/rows/EOF, or
+	// a COM_STMT_PREPARE response's OK/param defs/EOF/column defs/EOF.
+	resState  int
+	resCols   uint64
+	resRows   uint64
+	resParams uint64
+
+	// Prepared statements: stmts maps a statement ID (learned from the
+	// PREPARE response) to its canonicalized query text, so later
+	// COM_STMT_EXECUTE/RESET calls can be attributed back to it.
+	stmts                   map[uint32]string
+	awaitingPrepareResponse bool
+	pendingStmtText         string
+
+	// pendingEvent is the JSON event (see output.go) being built up for the
+	// request currently in flight, or nil if the event sink is disabled.
+	pendingEvent *queryEvent
+
+	// serverAddr is the server's "host:port" (bracketed per RFC 3986 when
+	// host is an IPv6 literal), precomputed once in mysqlStreamFactory.New.
+	serverAddr string
 }
 
 type queryData struct {
-	count uint64
-	bytes uint64
-	times [TIME_BUCKETS]uint64
+	count        uint64
+	bytes        uint64
+	times        [TIME_BUCKETS]uint64
+	rows         uint64
+	affected     uint64
+	errors       uint64
+	errorsByCode map[uint16]uint64
 }
 
 var start int64 = UnixNow()
 var qbuf map[string]*queryData = make(map[string]*queryData)
 var querycount int
-var chmap map[string]*source = make(map[string]*source)
+var chmap map[string]*session = make(map[string]*session)
 var verbose bool = false
 var noclean bool = false
 var dirty bool = false
@@ -105,8 +140,10 @@ var stats struct {
 		rcvd      uint64
 		rcvd_sync uint64
 	}
-	desyncs uint64
-	streams uint64
+	desyncs       uint64
+	streamsV4     uint64
+	streamsV6     uint64
+	eventsDropped uint64
 }
 
 func UnixNow() int64 {
@@ -124,13 +161,17 @@ func main() {
 	var formatstr *string = flag.String("f", "#s:#q", "Format for output aggregation")
 	var sortby *string = flag.String("s", "count", "Sort by: count, max, avg, maxbytes, avgbytes")
 	var cutoff *int = flag.Int("c", 0, "Only show queries over count/second")
+	var idletimeout *int = flag.Int("T", 90, "Seconds of inactivity before a stream is flushed")
+	var output *string = flag.String("o", "", "Structured event output: \"json\" (stdout) or \"ndjson:/path/file\"")
 	flag.Parse()
 
 	verbose = *doverbose
 	noclean = *nocleanquery
 	port = uint16(*lport)
+	portString = fmt.Sprintf("%d", port)
 	dirty = *ldirty
 	parseFormat(*formatstr)
+	initEventSink(*output)
 	rand.Seed(time.Now().UnixNano())
 
 	log.SetPrefix("")
@@ -150,18 +191,42 @@ func main() {
 
 	last := UnixNow()
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	//fmt.Println(packetSource)
+	streamFactory := &mysqlStreamFactory{}
+	streamPool := tcpassembly.NewStreamPool(streamFactory)
+	assembler := tcpassembly.NewAssembler(streamPool)
+
+	if *idletimeout <= 0 {
+		log.Fatalf("-T must be a positive number of seconds, got %d", *idletimeout)
+	}
+	idleTimeout := time.Duration(*idletimeout) * time.Second
 
-	for pkt := range packetSource.Packets() {
-		handlePacket(pkt)
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packets := packetSource.Packets()
+
+	// assembler is documented as not safe for concurrent use, so the idle
+	// flush has to happen on this same goroutine rather than a separate
+	// ticker goroutine racing handlePacket's calls into it.
+	flushTicker := time.NewTicker(idleTimeout / 2)
+	defer flushTicker.Stop()
+
+	for {
+		select {
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+			handlePacket(pkt, assembler)
+
+			// simple output printer... this should be super fast since we expect that a
+			// system like this will have relatively few unique queries once they're
+			// canonicalized.
+			if !verbose && querycount%1000 == 0 && last < UnixNow()-int64(*period) {
+				last = UnixNow()
+				handleStatusUpdate(*displaycount, *sortby, *cutoff)
+			}
 
-		// simple output printer... this should be super fast since we expect that a
-		// system like this will have relatively few unique queries once they're
-		// canonicalized.
-		if !verbose && querycount%1000 == 0 && last < UnixNow()-int64(*period) {
-			last = UnixNow()
-			handleStatusUpdate(*displaycount, *sortby, *cutoff)
+		case <-flushTicker.C:
+			assembler.FlushOlderThan(time.Now().Add(-idleTimeout))
 		}
 	}
 }
@@ -202,16 +267,16 @@ func handleStatusUpdate(displaycount int, sortby string, cutoff int) {
 		float64(querycount)/elapsed, COLOR_DEFAULT)
 	log.SetFlags(0)
 
-	log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams",
+	log.Printf("%d packets (%0.2f%% on synchronized streams) / %d desyncs / %d streams (%d v4 / %d v6)",
 		stats.packets.rcvd, float64(stats.packets.rcvd_sync)/float64(stats.packets.rcvd)*100,
-		stats.desyncs, stats.streams)
+		stats.desyncs, stats.streamsV4+stats.streamsV6, stats.streamsV4, stats.streamsV6)
 
 	// global timing values
 	gmin, gavg, gmax := calculateTimes(&times)
 	log.Printf("%0.2fms min / %0.2fms avg / %0.2fms max query times", gmin, gavg, gmax)
 	log.Printf("%d unique results in this filter", len(qbuf))
 	log.Printf(" ")
-	log.Printf("%s count     %sqps     %s  min    avg   max      %sbytes      per qry%s",
+	log.Printf("%s count     %sqps     %s  min    avg   max      %sbytes      per qry   rows    err%%%s",
 		COLOR_YELLOW, COLOR_CYAN, COLOR_YELLOW, COLOR_GREEN, COLOR_DEFAULT)
 
 	// we cheat so badly here...
@@ -236,10 +301,12 @@ func handleStatusUpdate(displaycount int, sortby string, cutoff int) {
 			sorted = float64(bavg)
 		}
 
+		errpct := float64(c.errors) / float64(c.count) * 100
+
 		tmp = append(tmp, sortable{sorted, fmt.Sprintf(
-			"%s%6d  %s%7.2f/s  %s%6.2f %6.2f %6.2f  %s%9db %6db %s%s%s",
+			"%s%6d  %s%7.2f/s  %s%6.2f %6.2f %6.2f  %s%9db %6db %8d %6.2f%% %s%s%s",
 			COLOR_YELLOW, c.count, COLOR_CYAN, qps, COLOR_YELLOW, qmin, qavg, qmax,
-			COLOR_GREEN, c.bytes, bavg, COLOR_WHITE, q, COLOR_DEFAULT)})
+			COLOR_GREEN, c.bytes, bavg, c.rows, errpct, COLOR_WHITE, q, COLOR_DEFAULT)})
 	}
 	sort.Sort(tmp)
 
@@ -253,8 +320,12 @@ func handleStatusUpdate(displaycount int, sortby string, cutoff int) {
 	}
 }
 
-// Do something with a packet for a source.
-func processPacket(rs *source, request bool, data []byte) {
+// Do something with a chunk of reassembled stream data for a session. This
+// may be less than, exactly, or more than one MySQL packet, so bytes are
+// buffered on the session and carved off as whole packets become available.
+// While a session is not synchronized, request bytes that do not start with a
+// whole COM_QUERY or COM_STMT_PREPARE packet are discarded, not buffered.
+func processPacket(rs *session, request bool, data []byte) {
 	//		log.Printf("[%s] request=%t, got %d bytes", rs.src, request,
 	//			len(data))
 
@@ -263,58 +334,204 @@ func processPacket(rs *source, request bool, data []byte) {
 		stats.packets.rcvd_sync++
 	}
 
-	var ptype int = -1
-	var pdata []byte
-
 	if request {
-		// If we still have response buffer, we're in some weird state and
-		// didn't successfully process the response.
-		if rs.resbuffer != nil {
-			//				log.Printf("[%s] possibly pipelined request? %d bytes",
-			//					rs.src, len(rs.resbuffer))
-			stats.desyncs++
-			rs.resbuffer = nil
-			rs.synced = false
-		}
-		rs.reqbuffer = data
-		ptype, pdata = carvePacket(&rs.reqbuffer)
+		processRequest(rs, data)
 	} else {
-		// FIXME: For now we're not doing anything with response data, just using the first packet
-		// after a query to determine latency.
+		processResponse(rs, data)
+	}
+}
+
+// processRequest carves every fully-buffered MySQL client packet out of the
+// request bytes and, for each one once we're synchronized on a COM_QUERY or
+// COM_STMT_PREPARE, records it. A single Reassembled chunk can contain more than one request
+// packet (pipelined writes, or segments that coalesce after a retransmit),
+// so -- like processResponse -- this has to keep carving until the buffer
+// is exhausted rather than handling just the first one.
+func processRequest(rs *session, data []byte) {
+	// If we still have response buffer, we're in some weird state and
+	// didn't successfully process the response.
+	if rs.resbuffer != nil {
+		//			log.Printf("[%s] possibly pipelined request? %d bytes",
+		//				rs.src, len(rs.resbuffer))
+		stats.desyncs++
 		rs.resbuffer = nil
-		ptype, pdata = 0, data
+		rs.resState = RES_IDLE
+		rs.synced = false
 	}
+	rs.reqbuffer = append(rs.reqbuffer, data...)
+
+	for {
+		ptype, pdata := carvePacket(&rs.reqbuffer)
+
+		// The synchronization logic: if we're not presently, then we want to
+		// keep going until we are capable of carving off of a request/query.
+		if !rs.synced {
+			if ptype != COM_QUERY && ptype != COM_STMT_PREPARE {
+				rs.reqbuffer = nil
+				return
+			}
+			rs.synced = true
+		}
 
-	// The synchronization logic: if we're not presently, then we want to
-	// keep going until we are capable of carving off of a request/query.
-	if !rs.synced {
-		if !(request && ptype == COM_QUERY) {
-			rs.reqbuffer, rs.resbuffer = nil, nil
+		// No (full) packet detected yet. Continue on our way.
+		if ptype == -1 {
 			return
 		}
-		rs.synced = true
-	}
-	//log.Printf("[%s] request=%b ptype=%d plen=%d", rs.src, request, ptype, len(pdata))
+		plen := uint64(len(pdata))
 
-	// No (full) packet detected yet. Continue on our way.
-	if ptype == -1 {
-		return
+		if ptype == COM_STMT_CLOSE {
+			// The server never replies to COM_STMT_CLOSE, so there's no
+			// response to wait on -- just forget the statement and move on.
+			if len(pdata) >= 4 {
+				delete(rs.stmts, binary.LittleEndian.Uint32(pdata[0:4]))
+			}
+			continue
+		}
+
+		if ptype == COM_STMT_PREPARE {
+			if dirty {
+				rs.pendingStmtText = string(pdata)
+			} else {
+				rs.pendingStmtText = Canonicalize(pdata)
+			}
+			rs.awaitingPrepareResponse = true
+		}
+
+		// COM_STMT_EXECUTE and COM_STMT_RESET both lead with the statement ID
+		// of a previously prepared statement rather than textual SQL, so look
+		// up the query we canonicalized back when it was PREPAREd.
+		var stmtText string
+		if ptype == COM_STMT_EXECUTE || ptype == COM_STMT_RESET {
+			stmtText = "(unknown prepared statement)"
+			if len(pdata) >= 4 {
+				if t, ok := rs.stmts[binary.LittleEndian.Uint32(pdata[0:4])]; ok {
+					stmtText = t
+				}
+			}
+		}
+
+		// This is for sure a request, so let's count it as one.
+		if rs.reqSent != nil {
+			//			log.Printf("[%s] ...sending two requests without a response?",
+			//				rs.src)
+		}
+		tnow := time.Now()
+		rs.reqSent = &tnow
+
+		if eventCh != nil {
+			ev := &queryEvent{
+				Timestamp: tnow,
+				Client:    rs.src,
+				Server:    rs.serverAddr,
+				Command:   commandName(ptype),
+				BytesSent: plen,
+			}
+			switch ptype {
+			case COM_QUERY, COM_STMT_PREPARE:
+				ev.RawQuery = string(pdata)
+				if dirty {
+					ev.Query = string(pdata)
+				} else {
+					ev.Query = Canonicalize(pdata)
+				}
+				ev.Route = parseRoute(pdata)
+			case COM_STMT_EXECUTE, COM_STMT_RESET:
+				ev.Query = stmtText
+			default:
+				ev.Query = Canonicalize(pdata)
+			}
+			rs.pendingEvent = ev
+		} else {
+			rs.pendingEvent = nil
+		}
+
+		// Convert this request into whatever format the user wants.
+		querycount++
+		var text string
+
+		for _, item := range format {
+			switch item.(type) {
+			case int:
+				switch item.(int) {
+				case F_NONE:
+					log.Fatalf("F_NONE in format string")
+				case F_QUERY:
+					if ptype == COM_STMT_EXECUTE || ptype == COM_STMT_RESET {
+						text += stmtText
+					} else if dirty {
+						text += string(pdata)
+					} else {
+						text += Canonicalize(pdata)
+					}
+				case F_ROUTE:
+					if ptype == COM_STMT_EXECUTE || ptype == COM_STMT_RESET {
+						text += stmtText
+						break
+					}
+					// Routes are in the query like:
+					//     SELECT /* hostname:route */ FROM ...
+					// We remove the hostname so routes can be condensed.
+					if route := parseRoute(pdata); route != "" {
+						text += route
+					} else {
+						text += "(unknown) " + Canonicalize(pdata)
+					}
+				case F_SOURCE:
+					text += rs.src
+				case F_SOURCEIP:
+					text += rs.srcip
+				default:
+					log.Fatalf("Unknown F_XXXXXX int in format string")
+				}
+			case string:
+				text += item.(string)
+			default:
+				log.Fatalf("Unknown type in format string")
+			}
+		}
+		qdata, ok := qbuf[text]
+		if !ok {
+			qdata = &queryData{}
+			qbuf[text] = qdata
+		}
+		qdata.count++
+		qdata.bytes += plen
+		rs.qtext, rs.qdata, rs.qbytes = text, qdata, plen
 	}
-	plen := uint64(len(pdata))
-
-	// If this is a response then we want to record the timing and
-	// store it with this channel so we can keep track of that.
-	var reqtime uint64
-	if !request {
-		// Keep adding the bytes we're getting, since this is probably still part of
-		// an earlier response
+}
+
+// processResponse carves every MySQL server packet out of the buffered
+// response bytes, using the first one to record query latency and feeding
+// all of them into the OK/ERR/result-set state machine so we can attribute
+// rows and errors back to the query that triggered them.
+func processResponse(rs *session, data []byte) {
+	rs.resbuffer = append(rs.resbuffer, data...)
+
+	for {
+		ptype, pdata := carvePacket(&rs.resbuffer)
+		if ptype == -1 {
+			return
+		}
+		plen := uint64(len(pdata))
+
+		// carvePacket splits the payload's first byte off as ptype, but the
+		// response decoder needs the whole payload, first byte included.
+		payload := append([]byte{byte(ptype)}, pdata...)
+
+		// Keep adding the bytes we're getting, since this is probably still
+		// part of an earlier response we've already timed.
 		if rs.reqSent == nil {
 			if rs.qdata != nil {
 				rs.qdata.bytes += plen
 			}
-			return
+			if rs.pendingEvent != nil {
+				rs.pendingEvent.BytesRecv += plen
+			}
+			consumeResponsePacket(rs, payload)
+			continue
 		}
-		reqtime = uint64(time.Since(*rs.reqSent).Nanoseconds())
+
+		reqtime := uint64(time.Since(*rs.reqSent).Nanoseconds())
 
 		// We keep track of per-source, global, and per-query timings.
 		randn := rand.Intn(TIME_BUCKETS)
@@ -327,6 +544,10 @@ func processPacket(rs *source, request bool, data []byte) {
 			rs.qdata.times[randn] = reqtime
 			rs.qdata.bytes += plen
 		}
+		if rs.pendingEvent != nil {
+			rs.pendingEvent.LatencyUs = reqtime / 1000
+			rs.pendingEvent.BytesRecv += plen
+		}
 		rs.reqSent = nil
 
 		// If we're in verbose mode, just dump statistics from this one.
@@ -335,68 +556,8 @@ func processPacket(rs *source, request bool, data []byte) {
 				COLOR_YELLOW, rs.qbytes, float64(reqtime)/1000000, COLOR_DEFAULT)
 		}
 
-		return
-	}
-
-	// This is for sure a request, so let's count it as one.
-	if rs.reqSent != nil {
-		//			log.Printf("[%s] ...sending two requests without a response?",
-		//				rs.src)
-	}
-	tnow := time.Now()
-	rs.reqSent = &tnow
-
-	// Convert this request into whatever format the user wants.
-	querycount++
-	var text string
-
-	for _, item := range format {
-		switch item.(type) {
-		case int:
-			switch item.(int) {
-			case F_NONE:
-				log.Fatalf("F_NONE in format string")
-			case F_QUERY:
-				if dirty {
-					text += string(pdata)
-				} else {
-					text += cleanupQuery(pdata)
-				}
-			case F_ROUTE:
-				// Routes are in the query like:
-				//     SELECT /* hostname:route */ FROM ...
-				// We remove the hostname so routes can be condensed.
-				parts := strings.SplitN(string(pdata), " ", 5)
-				if len(parts) >= 4 && parts[1] == "/*" && parts[3] == "*/" {
-					if strings.Contains(parts[2], ":") {
-						text += strings.SplitN(parts[2], ":", 2)[1]
-					} else {
-						text += parts[2]
-					}
-				} else {
-					text += "(unknown) " + cleanupQuery(pdata)
-				}
-			case F_SOURCE:
-				text += rs.src
-			case F_SOURCEIP:
-				text += rs.srcip
-			default:
-				log.Fatalf("Unknown F_XXXXXX int in format string")
-			}
-		case string:
-			text += item.(string)
-		default:
-			log.Fatalf("Unknown type in format string")
-		}
+		consumeResponsePacket(rs, payload)
 	}
-	qdata, ok := qbuf[text]
-	if !ok {
-		qdata = &queryData{}
-		qbuf[text] = qdata
-	}
-	qdata.count++
-	qdata.bytes += plen
-	rs.qtext, rs.qdata, rs.qbytes = text, qdata, plen
 }
 
 // carvePacket tries to pull a packet out of a slice of bytes. If so, it removes
@@ -428,176 +589,35 @@ func carvePacket(buf *[]byte) (int, []byte) {
 	return ptype, data
 }
 
-// extract the data... we have to figure out where it is, which means extracting data
-// from the various headers until we get the location we want.  this is crude, but
-// functional and it should be fast.
-func handlePacket(pkt gopacket.Packet) {
-	ipLayer := pkt.Layer(layers.LayerTypeIPv4)
-	if ipLayer == nil {
+// extract the IP and TCP layers from a packet and feed them to the stream
+// assembler, which takes care of reordering, retransmits, and splitting the
+// bytes out to the right session/direction for us.
+func handlePacket(pkt gopacket.Packet, assembler *tcpassembly.Assembler) {
+	var netFlow gopacket.Flow
+	if ipLayer := pkt.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		netFlow = ipLayer.(*layers.IPv4).NetworkFlow()
+	} else if ipLayer := pkt.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		netFlow = ipLayer.(*layers.IPv6).NetworkFlow()
+	} else {
 		return
 	}
 
-	ip, _ := ipLayer.(*layers.IPv4)
-	//fmt.Printf("From src host %s to dst host %s\n", ip.SrcIP, ip.DstIP)
-
-	_ = ip
-
 	tcpLayer := pkt.Layer(layers.LayerTypeTCP)
 	if tcpLayer == nil {
 		return
 	}
 
 	tcp, _ := tcpLayer.(*layers.TCP)
-	//fmt.Printf("From src port %d to dst port %d\n", tcp.SrcPort, tcp.DstPort)
-
-	_ = tcp
 
 	if len(tcp.BaseLayer.Payload) <= 0 {
 		return
 	}
 
-	// This is either an inbound or outbound packet. Determine by seeing which
-	// end contains our port. Either way, we want to put this on the channel of
-	// the remote end.
-	var src string
-	var request bool = false
-	if uint16(tcp.SrcPort) == port {
-		src = fmt.Sprintf("%s:%d", ip.DstIP, tcp.DstPort)
-	} else if uint16(tcp.DstPort) == port {
-		src = fmt.Sprintf("%s:%d", ip.SrcIP, tcp.SrcPort)
-		request = true
-		//log.Printf("request from %s", src)
-	} else {
+	if uint16(tcp.SrcPort) != port && uint16(tcp.DstPort) != port {
 		log.Fatalf("got packet src = %d, dst = %d", tcp.SrcPort, tcp.DstPort)
 	}
 
-	// Get the data structure for this source, then do something.
-	rs, ok := chmap[src]
-	if !ok {
-		srcip := src[0:strings.Index(src, ":")]
-		rs = &source{src: src, srcip: srcip, synced: false}
-		stats.streams++
-		chmap[src] = rs
-	}
-
-	// Now with a source, process the packet.
-	processPacket(rs, request, tcp.BaseLayer.Payload)
-}
-
-// scans forward in the query given the current type and returns when we encounter
-// a new type and need to stop scanning.  returns the size of the last token and
-// the type of it.
-func scanToken(query []byte) (length int, thistype int) {
-	if len(query) < 1 {
-		log.Fatalf("scanToken called with empty query")
-	}
-
-	//no clean queries
-	if verbose && noclean {
-		return len(query), TOKEN_OTHER
-	}
-	// peek at the first byte, then loop
-	b := query[0]
-	switch {
-	case b == 39 || b == 34: // '"
-		started_with := b
-		escaped := false
-		for i := 1; i < len(query); i++ {
-			switch query[i] {
-			case started_with:
-				if escaped {
-					escaped = false
-					continue
-				}
-				return i + 1, TOKEN_QUOTE
-			case 92:
-				escaped = true
-			default:
-				escaped = false
-			}
-		}
-		return len(query), TOKEN_QUOTE
-
-	case b >= 48 && b <= 57: // 0-9
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] >= 48 && query[i] <= 57: // 0-9
-				// do nothing
-			default:
-				return i, TOKEN_NUMBER
-			}
-		}
-		return len(query), TOKEN_NUMBER
-
-	case b == 32 || (b >= 9 && b <= 13): // whitespace
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] == 32 || (query[i] >= 9 && query[i] <= 13):
-				// Eat all whitespace
-			default:
-				return i, TOKEN_WHITESPACE
-			}
-		}
-		return len(query), TOKEN_WHITESPACE
-
-	case (b >= 65 && b <= 90) || (b >= 97 && b <= 122): // a-zA-Z
-		for i := 1; i < len(query); i++ {
-			switch {
-			case query[i] >= 48 && query[i] <= 57:
-				// Numbers, allow.
-			case (query[i] >= 65 && query[i] <= 90) || (query[i] >= 97 && query[i] <= 122):
-				// Letters, allow.
-			case query[i] == 36 || query[i] == 95:
-				// $ and _
-			default:
-				return i, TOKEN_WORD
-			}
-		}
-		return len(query), TOKEN_WORD
-
-	default: // everything else
-		return 1, TOKEN_OTHER
-	}
-
-	// shouldn't get here
-	log.Fatalf("scanToken failure: [%s]", query)
-	return
-}
-
-func cleanupQuery(query []byte) string {
-	// iterate until we hit the end of the query...
-	var qspace []string
-	for i := 0; i < len(query); {
-		length, toktype := scanToken(query[i:])
-
-		switch toktype {
-		case TOKEN_WORD, TOKEN_OTHER:
-			qspace = append(qspace, string(query[i:i+length]))
-
-		case TOKEN_NUMBER, TOKEN_QUOTE:
-			qspace = append(qspace, "?")
-
-		case TOKEN_WHITESPACE:
-			qspace = append(qspace, " ")
-
-		default:
-			log.Fatalf("scanToken returned invalid token type %d", toktype)
-		}
-
-		i += length
-	}
-
-	// Remove hostname from the route information if it's present
-	tmp := strings.Join(qspace, "")
-
-	parts := strings.SplitN(tmp, " ", 5)
-	if len(parts) >= 5 && parts[1] == "/*" && parts[3] == "*/" {
-		if strings.Contains(parts[2], ":") {
-			tmp = parts[0] + " /* " + strings.SplitN(parts[2], ":", 2)[1] + " */ " + parts[4]
-		}
-	}
-
-	return strings.Replace(tmp, "?, ", "", -1)
+	assembler.AssembleWithTimestamp(netFlow, tcp, pkt.Metadata().Timestamp)
 }
 
 // parseFormat takes a string and parses it out into the given format slice
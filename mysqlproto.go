@@ -0,0 +1,354 @@
+/*
+ * mysqlproto.go
+ *
+ * Decoding for the server->client half of the MySQL protocol: enough of
+ * OK/ERR/result-set framing to tell a query apart from an error, and to
+ * know how many rows came back, without pulling in a full client library.
+ */
+
+package main
+
+// Response packet states for a session. A response is either a single
+// OK/ERR/EOF packet, a result set (column count, that many column
+// definitions, an EOF, then rows until a terminating EOF), or -- when
+// rs.awaitingPrepareResponse is set -- a COM_STMT_PREPARE response (an OK
+// carrying the new statement ID, then that many param defs/EOF and column
+// defs/EOF).
+const (
+	RES_IDLE = iota
+	RES_COLUMN_DEFS
+	RES_COLUMN_EOF
+	RES_ROWS
+	RES_PREPARE_PARAMS
+	RES_PREPARE_PARAMS_EOF
+	RES_PREPARE_COLUMNS
+	RES_PREPARE_COLUMNS_EOF
+)
+
+const (
+	RESP_OK  = 0x00
+	RESP_EOF = 0xfe
+	RESP_ERR = 0xff
+)
+
+// readLenEncInt decodes a MySQL length-encoded integer from the front of
+// data, returning its value and the number of bytes it occupied. ok is
+// false if data doesn't contain a complete length-encoded integer.
+func readLenEncInt(data []byte) (value uint64, n int, ok bool) {
+	if len(data) < 1 {
+		return 0, 0, false
+	}
+	switch {
+	case data[0] < 0xfb:
+		return uint64(data[0]), 1, true
+	case data[0] == 0xfc:
+		if len(data) < 3 {
+			return 0, 0, false
+		}
+		return uint64(data[1]) | uint64(data[2])<<8, 3, true
+	case data[0] == 0xfd:
+		if len(data) < 4 {
+			return 0, 0, false
+		}
+		return uint64(data[1]) | uint64(data[2])<<8 | uint64(data[3])<<16, 4, true
+	case data[0] == 0xfe:
+		if len(data) < 9 {
+			return 0, 0, false
+		}
+		var v uint64
+		for i := 0; i < 8; i++ {
+			v |= uint64(data[1+i]) << (8 * uint(i))
+		}
+		return v, 9, true
+	}
+	// 0xfb (NULL) and anything else aren't valid lengths here.
+	return 0, 0, false
+}
+
+// okPacket holds the fields of a parsed OK packet (first byte 0x00, or 0xfe
+// when sent as an EOF-deprecated OK for a result set).
+type okPacket struct {
+	affectedRows uint64
+	lastInsertId uint64
+	statusFlags  uint16
+	warnings     uint16
+}
+
+func parseOKPacket(data []byte) okPacket {
+	var ok okPacket
+	if len(data) < 1 {
+		return ok
+	}
+	rest := data[1:]
+	var n int
+	var valid bool
+	ok.affectedRows, n, valid = readLenEncInt(rest)
+	if !valid {
+		return ok
+	}
+	rest = rest[n:]
+	ok.lastInsertId, n, valid = readLenEncInt(rest)
+	if !valid {
+		return ok
+	}
+	rest = rest[n:]
+	if len(rest) >= 2 {
+		ok.statusFlags = uint16(rest[0]) | uint16(rest[1])<<8
+		rest = rest[2:]
+	}
+	if len(rest) >= 2 {
+		ok.warnings = uint16(rest[0]) | uint16(rest[1])<<8
+	}
+	return ok
+}
+
+// errPacket holds the fields of a parsed ERR packet (first byte 0xff).
+type errPacket struct {
+	errorCode uint16
+	sqlState  string
+	message   string
+}
+
+func parseERRPacket(data []byte) errPacket {
+	var e errPacket
+	if len(data) < 3 {
+		return e
+	}
+	e.errorCode = uint16(data[1]) | uint16(data[2])<<8
+	rest := data[3:]
+	// Modern servers include a '#'-prefixed 5-character SQL state before the
+	// human-readable message; older ones go straight to the message.
+	if len(rest) >= 6 && rest[0] == '#' {
+		e.sqlState = string(rest[1:6])
+		rest = rest[6:]
+	}
+	e.message = string(rest)
+	return e
+}
+
+// isEOFPacket reports whether data looks like an EOF marker packet: first
+// byte 0xfe and short enough that it can't be a length-encoded result-set
+// row or an 8-byte-integer OK packet.
+func isEOFPacket(data []byte) bool {
+	return len(data) > 0 && data[0] == RESP_EOF && len(data) < 9
+}
+
+// isOKPacketShaped reports whether data is shaped exactly like an OK packet:
+// leading 0x00, two length-encoded integers, then a 4-byte status/warnings
+// tail with nothing left over. Servers and clients negotiating
+// CLIENT_DEPRECATE_EOF replace the EOF that used to separate column defs
+// from rows, and the one that used to terminate a result set, with an OK
+// packet instead, so both RES_COLUMN_EOF and RES_ROWS need to recognize
+// this shape as a terminator too. This can't be told apart from a data row
+// whose leading column happens to be an empty string with full certainty --
+// that ambiguity is inherent to the wire format without tracking
+// CLIENT_DEPRECATE_EOF from the handshake -- but requiring the packet to
+// fully and exactly match the OK packet layout makes a false match unlikely.
+func isOKPacketShaped(data []byte) bool {
+	if len(data) < 7 || data[0] != RESP_OK {
+		return false
+	}
+	rest := data[1:]
+	_, n, ok := readLenEncInt(rest)
+	if !ok {
+		return false
+	}
+	rest = rest[n:]
+	_, n, ok = readLenEncInt(rest)
+	if !ok {
+		return false
+	}
+	rest = rest[n:]
+	return len(rest) == 4
+}
+
+// isResultSetTerminator reports whether data looks like whatever ends a
+// result set's column-def block or row block: a legacy EOF packet, or (with
+// CLIENT_DEPRECATE_EOF) an OK packet in its place.
+func isResultSetTerminator(data []byte) bool {
+	return isEOFPacket(data) || isOKPacketShaped(data)
+}
+
+// prepareOKPacket holds the fields of a COM_STMT_PREPARE response's leading
+// OK packet: the new statement ID and how many param/column definitions
+// follow it.
+type prepareOKPacket struct {
+	statementID uint32
+	numColumns  uint16
+	numParams   uint16
+	warnings    uint16
+}
+
+func parsePrepareOK(data []byte) (p prepareOKPacket, ok bool) {
+	if len(data) < 12 || data[0] != RESP_OK {
+		return p, false
+	}
+	p.statementID = uint32(data[1]) | uint32(data[2])<<8 | uint32(data[3])<<16 | uint32(data[4])<<24
+	p.numColumns = uint16(data[5]) | uint16(data[6])<<8
+	p.numParams = uint16(data[7]) | uint16(data[8])<<8
+	p.warnings = uint16(data[10]) | uint16(data[11])<<8
+	return p, true
+}
+
+// consumeResponsePacket feeds one already-carved response packet into the
+// session's result-parsing state machine, attributing rows/affected rows/
+// errors to rs.qdata once they're known.
+func consumeResponsePacket(rs *session, pdata []byte) {
+	if len(pdata) == 0 {
+		return
+	}
+
+	if rs.awaitingPrepareResponse && rs.resState == RES_IDLE {
+		consumePrepareResponse(rs, pdata)
+		return
+	}
+
+	switch rs.resState {
+	case RES_IDLE:
+		switch {
+		case pdata[0] == RESP_OK:
+			ok := parseOKPacket(pdata)
+			if rs.qdata != nil {
+				rs.qdata.affected += ok.affectedRows
+			}
+			if rs.pendingEvent != nil {
+				rs.pendingEvent.Affected = ok.affectedRows
+			}
+			finishEvent(rs)
+		case pdata[0] == RESP_ERR:
+			e := parseERRPacket(pdata)
+			if rs.qdata != nil {
+				rs.qdata.errors++
+				if rs.qdata.errorsByCode == nil {
+					rs.qdata.errorsByCode = make(map[uint16]uint64)
+				}
+				rs.qdata.errorsByCode[e.errorCode]++
+			}
+			if rs.pendingEvent != nil {
+				rs.pendingEvent.ErrorCode = e.errorCode
+			}
+			finishEvent(rs)
+		case isEOFPacket(pdata):
+			// A bare EOF with no preceding result set; nothing to record.
+		default:
+			cols, _, ok := readLenEncInt(pdata)
+			if !ok || cols == 0 {
+				return
+			}
+			rs.resState = RES_COLUMN_DEFS
+			rs.resCols = cols
+			rs.resRows = 0
+		}
+
+	case RES_COLUMN_DEFS:
+		rs.resCols--
+		if rs.resCols == 0 {
+			rs.resState = RES_COLUMN_EOF
+		}
+
+	case RES_COLUMN_EOF:
+		// Normally this packet is the EOF separating column defs from rows.
+		// With CLIENT_DEPRECATE_EOF there's no separator packet at all, so
+		// if this doesn't look like a terminator, it's already the first
+		// (and, if followed immediately by a terminator, only) row.
+		if isResultSetTerminator(pdata) {
+			if rs.qdata != nil {
+				rs.qdata.rows += rs.resRows
+			}
+			if rs.pendingEvent != nil {
+				rs.pendingEvent.Rows = rs.resRows
+			}
+			finishEvent(rs)
+			rs.resState = RES_IDLE
+			rs.resRows = 0
+			return
+		}
+		rs.resState = RES_ROWS
+		rs.resRows++
+
+	case RES_ROWS:
+		if isResultSetTerminator(pdata) {
+			if rs.qdata != nil {
+				rs.qdata.rows += rs.resRows
+			}
+			if rs.pendingEvent != nil {
+				rs.pendingEvent.Rows = rs.resRows
+			}
+			finishEvent(rs)
+			rs.resState = RES_IDLE
+			rs.resRows = 0
+			return
+		}
+		rs.resRows++
+
+	case RES_PREPARE_PARAMS:
+		rs.resParams--
+		if rs.resParams == 0 {
+			rs.resState = RES_PREPARE_PARAMS_EOF
+		}
+
+	case RES_PREPARE_PARAMS_EOF:
+		if rs.resCols > 0 {
+			rs.resState = RES_PREPARE_COLUMNS
+		} else {
+			rs.resState = RES_IDLE
+		}
+
+	case RES_PREPARE_COLUMNS:
+		rs.resCols--
+		if rs.resCols == 0 {
+			rs.resState = RES_PREPARE_COLUMNS_EOF
+		}
+
+	case RES_PREPARE_COLUMNS_EOF:
+		rs.resState = RES_IDLE
+	}
+}
+
+// consumePrepareResponse handles the first packet of a COM_STMT_PREPARE
+// response: either an ERR (the prepare failed) or an OK carrying the new
+// statement ID, after which we know how many param/column definitions to
+// expect before we're back to RES_IDLE.
+func consumePrepareResponse(rs *session, pdata []byte) {
+	rs.awaitingPrepareResponse = false
+
+	if pdata[0] == RESP_ERR {
+		e := parseERRPacket(pdata)
+		if rs.qdata != nil {
+			rs.qdata.errors++
+			if rs.qdata.errorsByCode == nil {
+				rs.qdata.errorsByCode = make(map[uint16]uint64)
+			}
+			rs.qdata.errorsByCode[e.errorCode]++
+		}
+		if rs.pendingEvent != nil {
+			rs.pendingEvent.ErrorCode = e.errorCode
+		}
+		finishEvent(rs)
+		rs.pendingStmtText = ""
+		return
+	}
+
+	p, ok := parsePrepareOK(pdata)
+	if !ok {
+		finishEvent(rs)
+		rs.pendingStmtText = ""
+		return
+	}
+	if rs.stmts == nil {
+		rs.stmts = make(map[uint32]string)
+	}
+	rs.stmts[p.statementID] = rs.pendingStmtText
+	rs.pendingStmtText = ""
+	finishEvent(rs)
+
+	switch {
+	case p.numParams > 0:
+		rs.resState = RES_PREPARE_PARAMS
+		rs.resParams = uint64(p.numParams)
+		rs.resCols = uint64(p.numColumns)
+	case p.numColumns > 0:
+		rs.resState = RES_PREPARE_COLUMNS
+		rs.resCols = uint64(p.numColumns)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * stream.go
+ *
+ * TCP stream reassembly glue: turns raw, possibly-reordered TCP segments
+ * into two ordered byte streams per connection (client->server and
+ * server->client) using gopacket/tcpassembly, the same building block
+ * Packetbeat's protocol decoders are built on.
+ */
+
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"time"
+)
+
+// portString is the string form of the port we're filtering on, precomputed
+// once so New() doesn't re-format it for every flow.
+var portString string
+
+// mysqlStreamFactory hands out one mysqlStream per (net, tcp) flow direction;
+// both directions of a connection share the same underlying session.
+type mysqlStreamFactory struct{}
+
+// mysqlStream feeds the reassembled bytes of one direction of a connection
+// into the shared session for that connection.
+type mysqlStream struct {
+	sess    *session
+	request bool
+}
+
+func (f *mysqlStreamFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	srcIP, dstIP := netFlow.Endpoints()
+	srcPort, dstPort := tcpFlow.Endpoints()
+
+	family := FAMILY_IPV4
+	if netFlow.EndpointType() == layers.EndpointIPv6 {
+		family = FAMILY_IPV6
+	}
+
+	var key, srcip, serverAddr string
+	var request bool
+	if srcPort.String() == portString {
+		key = hostPort(dstIP.String(), dstPort.String(), family)
+		srcip = dstIP.String()
+		serverAddr = hostPort(srcIP.String(), srcPort.String(), family)
+		request = false
+	} else {
+		key = hostPort(srcIP.String(), srcPort.String(), family)
+		srcip = srcIP.String()
+		serverAddr = hostPort(dstIP.String(), dstPort.String(), family)
+		request = true
+	}
+
+	rs, ok := chmap[key]
+	if !ok {
+		rs = &session{src: key, srcip: srcip, serverAddr: serverAddr, family: family, synced: false}
+		if family == FAMILY_IPV6 {
+			stats.streamsV6++
+		} else {
+			stats.streamsV4++
+		}
+		chmap[key] = rs
+	}
+	rs.lastActive = time.Now()
+
+	return &mysqlStream{sess: rs, request: request}
+}
+
+// hostPort formats an address and port for display, bracketing IPv6
+// literals per RFC 3986 so "addr:port" isn't ambiguous with the address's
+// own colons.
+func hostPort(ip, port string, family int) string {
+	if family == FAMILY_IPV6 {
+		return "[" + ip + "]:" + port
+	}
+	return ip + ":" + port
+}
+
+// Reassembled is called by the tcpassembly.Assembler with in-order runs of
+// bytes for this direction. A gap (Skip != 0) means the assembler gave up
+// waiting on a missing segment, so we flag a desync the same way a short
+// read used to.
+func (s *mysqlStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for _, r := range reassembly {
+		if r.Skip != 0 {
+			stats.desyncs++
+			s.sess.synced = false
+		}
+		if len(r.Bytes) == 0 {
+			continue
+		}
+		s.sess.lastActive = time.Now()
+		processPacket(s.sess, s.request, r.Bytes)
+	}
+}
+
+// ReassemblyComplete is called once this direction's FIN/RST has been seen,
+// or the assembler flushes it out on timeout. We only drop the session from
+// chmap once both directions are done with it.
+func (s *mysqlStream) ReassemblyComplete() {
+	s.sess.halfClosed++
+	if s.sess.halfClosed >= 2 {
+		delete(chmap, s.sess.src)
+	}
+}